@@ -21,6 +21,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
 	"k8s.io/kubernetes/pkg/util"
 )
 
@@ -29,6 +33,21 @@ type TimedValue struct {
 	Value string
 	Added time.Time
 	Next  time.Time
+	// Cost is how many rate limiter tokens processing this value should consume, e.g. the number
+	// of pods an eviction would affect. Zero or negative means 1, so existing callers that never
+	// set Cost keep throttling one value per token.
+	Cost int
+	// index is this value's current position in the owning TimedQueue's backing slice, kept up to
+	// date by Push/Pop/Swap so Remove can find it in O(log n) via heap.Remove rather than scanning.
+	index int
+}
+
+// cost returns v.Cost if positive, otherwise the default cost of 1.
+func (v TimedValue) cost() int {
+	if v.Cost > 0 {
+		return v.Cost
+	}
+	return 1
 }
 
 // now is used to test time
@@ -39,39 +58,65 @@ type TimedQueue []*TimedValue
 
 func (h TimedQueue) Len() int           { return len(h) }
 func (h TimedQueue) Less(i, j int) bool { return h[i].Next.Before(h[j].Next) }
-func (h TimedQueue) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h TimedQueue) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
 
 func (h *TimedQueue) Push(x interface{}) {
-	*h = append(*h, x.(*TimedValue))
+	value := x.(*TimedValue)
+	value.index = len(*h)
+	*h = append(*h, value)
 }
 
 func (h *TimedQueue) Pop() interface{} {
 	old := *h
 	n := len(old)
-	x := old[n-1]
+	value := old[n-1]
+	old[n-1] = nil
+	value.index = -1
 	*h = old[0 : n-1]
-	return x
+	return value
 }
 
 // A FIFO queue which additionally guarantees that any element can be added only once until
 // it is removed.
 type UniqueQueue struct {
-	lock  sync.Mutex
+	lock sync.Mutex
+	// queue holds items that are ready to be returned by Get. items indexes queue by Value, and
+	// together with TimedValue.index lets Remove locate an entry in O(log n) via heap.Remove
+	// instead of scanning queue.
 	queue TimedQueue
-	set   util.StringSet
+	items map[string]*TimedValue
+	// processing holds items that have been returned by Get but not yet released by Done.
+	processing util.StringSet
+	// dirty holds the latest TimedValue passed to Add for a value that was re-added while it was
+	// processing; Done moves it back onto queue/items once processing finishes.
+	dirty map[string]TimedValue
 }
 
 // Adds a new value to the queue if it wasn't added before, or was explicitly removed by the
-// Remove call. Returns true if new value was added.
+// Remove call. If value is currently processing (returned by Get but not yet Done), it is instead
+// recorded as dirty and will be returned by a future Get once Done is called. Returns true if
+// value is new, either to the queue or as dirty.
 func (q *UniqueQueue) Add(value TimedValue) bool {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	if q.set.Has(value.Value) {
+	if q.processing.Has(value.Value) {
+		_, alreadyDirty := q.dirty[value.Value]
+		q.dirty[value.Value] = value
+		return !alreadyDirty
+	}
+
+	if _, ok := q.items[value.Value]; ok {
 		return false
 	}
-	heap.Push(&q.queue, &value)
-	q.set.Insert(value.Value)
+	item := &value
+	heap.Push(&q.queue, item)
+	q.items[value.Value] = item
 	return true
 }
 
@@ -81,103 +126,538 @@ func (q *UniqueQueue) Remove(value string) bool {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	q.set.Delete(value)
-	for i, val := range q.queue {
-		if val.Value == value {
-			if i > 0 && i < len(q.queue)-1 {
-				q.queue = append(q.queue[0:i], q.queue[i+1:len(q.queue)]...)
-			} else if i > 0 {
-				q.queue = q.queue[0 : len(q.queue)-1]
-			} else {
-				q.queue = q.queue[1:len(q.queue)]
-			}
-			return true
-		}
+	_, wasDirty := q.dirty[value]
+	delete(q.dirty, value)
+
+	item, ok := q.items[value]
+	if !ok {
+		return wasDirty
 	}
-	return false
+	delete(q.items, value)
+	heap.Remove(&q.queue, item.index)
+	return true
 }
 
-// Returns the oldest added value that wasn't returned yet.
+// Returns the queued value with the earliest Next, and marks it as processing. Call Done
+// once it has been handled, whether or not it succeeded.
 func (q *UniqueQueue) Get() (TimedValue, bool) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	if len(q.queue) == 0 {
 		return TimedValue{}, false
 	}
-	result := q.queue.Pop().(*TimedValue)
-	q.set.Delete(result.Value)
+	result := heap.Pop(&q.queue).(*TimedValue)
+	delete(q.items, result.Value)
+	q.processing.Insert(result.Value)
+	delete(q.dirty, result.Value)
 	return *result, true
 }
 
+// Done marks value as no longer processing. If it was re-Add()ed while processing, the value it
+// was re-added with is moved onto the queue so a future Get returns it again.
+func (q *UniqueQueue) Done(value string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.processing.Delete(value)
+	if dirtyValue, ok := q.dirty[value]; ok {
+		delete(q.dirty, value)
+		item := &dirtyValue
+		heap.Push(&q.queue, item)
+		q.items[value] = item
+	}
+}
+
+// Len returns the number of values currently queued.
+func (q *UniqueQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.queue)
+}
+
+// Has reports whether value is currently tracked by the queue, whether it is ready, dirty, or
+// processing.
+func (q *UniqueQueue) Has(value string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.items[value]; ok {
+		return true
+	}
+	if _, ok := q.dirty[value]; ok {
+		return true
+	}
+	return q.processing.Has(value)
+}
+
+// defaultPriorityClass is the class used by callers that add values without
+// naming a class, so that existing single-class usages keep working
+// unchanged.
+const defaultPriorityClass = "normal"
+
+// RateLimiter throttles Try the same way util.RateLimiter does, but also allows its qps and
+// burst to be changed at runtime. This matters during large-scale outages, where operators need
+// to raise the eviction rate on the fly instead of restarting the controller manager and losing
+// every queue's pending items.
+type RateLimiter interface {
+	// ReserveN reserves n tokens without blocking, and returns a Reservation describing how long
+	// the caller should wait before treating them as consumed.
+	ReserveN(n int) Reservation
+	// SetLimit changes the qps and burst used by future ReserveN calls.
+	SetLimit(qps float32, burst int)
+}
+
+// Reservation is a delayed permission to consume tokens, returned by RateLimiter.ReserveN.
+type Reservation interface {
+	// OK reports whether the reservation can ever be honored. It is false when n exceeds the
+	// limiter's burst, in which case Delay returns rate.InfDuration rather than a usable wait.
+	OK() bool
+	// Delay returns how long the caller should wait before acting on the reservation, or zero if
+	// it may act immediately. Only meaningful when OK is true.
+	Delay() time.Duration
+	// Cancel releases the reserved tokens, for callers that decide not to act after all.
+	Cancel()
+}
+
+// rateLimiter adapts a golang.org/x/time/rate.Limiter, which supports changing its limit and
+// burst at runtime, to the RateLimiter interface.
+type rateLimiter struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimiter creates a RateLimiter allowing up to qps tokens per second, with bursts of up
+// to burst tokens.
+func NewRateLimiter(qps float32, burst int) RateLimiter {
+	return &rateLimiter{limiter: rate.NewLimiter(rate.Limit(qps), burst)}
+}
+
+func (r *rateLimiter) ReserveN(n int) Reservation {
+	return r.limiter.ReserveN(now(), n)
+}
+
+func (r *rateLimiter) SetLimit(qps float32, burst int) {
+	r.limiter.SetLimit(rate.Limit(qps))
+	r.limiter.SetBurst(burst)
+}
+
+// PriorityClass groups queued items that should be serviced with a shared
+// weight and an independent RateLimiter. For example, nodes hosting
+// system-critical workloads can be put in a high-weight class so eviction
+// keeps making progress even while a large batch of low-priority nodes is
+// queued behind them.
+type PriorityClass struct {
+	// Name identifies the class. Values are added to it with AddToClass.
+	Name string
+	// Weight is how much item Cost this class may dequeue, relative to
+	// other classes, each time deficits are refilled.
+	Weight int
+	// Limiter throttles only the items belonging to this class.
+	Limiter RateLimiter
+}
+
+// classQueue pairs a PriorityClass with its own heap of pending items and
+// the deficit counter used to give it weighted round-robin turns in Try.
+type classQueue struct {
+	class   PriorityClass
+	queue   UniqueQueue
+	deficit int
+}
+
+// backoffBase and backoffMax bound the exponential backoff AddRateLimited computes from an
+// item's failure count: base * 2^failures, capped at max.
+const (
+	backoffBase = 5 * time.Second
+	backoffMax  = 5 * time.Minute
+)
+
 // RateLimitedTimedQueue is a unique item priority queue ordered by the expected next time
-// of execution. It is also rate limited.
+// of execution. It is also rate limited, independently per PriorityClass.
 type RateLimitedTimedQueue struct {
-	queue   UniqueQueue
-	limiter util.RateLimiter
+	lock    sync.Mutex
+	order   []string
+	classes map[string]*classQueue
 	leak    bool
+	// failures counts, for each value since its last Forget, its AddRateLimited calls and the Try
+	// turns in which fn returned false, and drives the exponential backoff used to compute that
+	// value's next retry time.
+	failures map[string]int
+	// owners maps a queued value to the name of the priority class it was added under. It is the
+	// single source of truth for which class owns a value: AddToClass/AddRateLimitedToClass
+	// consult it to refuse adding a value under a second class while it's still owned by another,
+	// and Remove/Done use it to go straight to the owning class instead of checking every class.
+	owners map[string]string
 }
 
-// Creates new queue which will use given RateLimiter to oversee execution. If leak is true,
-// items which are rate limited will be leakped. Otherwise, rate limited items will be requeued.
-func NewRateLimitedTimedQueue(limiter util.RateLimiter, leak bool) *RateLimitedTimedQueue {
-	return &RateLimitedTimedQueue{
-		queue: UniqueQueue{
-			queue: TimedQueue{},
-			set:   util.NewStringSet(),
-		},
-		limiter: limiter,
-		leak:    leak,
+// Creates new queue which will use given RateLimiter to oversee execution. If leak is true, items
+// that aren't immediately allowed by the RateLimiter are requeued to be retried after their
+// reservation's delay, so other classes (or other due items) get a turn in the meantime. If leak
+// is false, Try blocks until the item's reservation is ready before moving on. See Try for the
+// full scheduling details.
+//
+// This is a convenience wrapper around NewPriorityRateLimitedTimedQueue for callers that don't
+// need more than one priority class.
+func NewRateLimitedTimedQueue(limiter RateLimiter, leak bool) *RateLimitedTimedQueue {
+	return NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: defaultPriorityClass, Weight: 1, Limiter: limiter},
+	}, leak)
+}
+
+// NewPriorityRateLimitedTimedQueue creates a new queue with one independently rate limited
+// heap per given PriorityClass. Classes are serviced in weighted round-robin order by Try: see
+// Try for the scheduling details, including what leak changes about how a rate-limited item is
+// handled.
+func NewPriorityRateLimitedTimedQueue(classes []PriorityClass, leak bool) *RateLimitedTimedQueue {
+	q := &RateLimitedTimedQueue{
+		order:    make([]string, 0, len(classes)),
+		classes:  make(map[string]*classQueue, len(classes)),
+		leak:     leak,
+		failures: make(map[string]int),
+		owners:   make(map[string]string),
+	}
+	for _, class := range classes {
+		if class.Weight <= 0 {
+			glog.Warningf("priority class %q has non-positive weight %d; defaulting to 1, since a "+
+				"non-positive weight would never refill and would wedge Try's round-robin", class.Name, class.Weight)
+			class.Weight = 1
+		}
+		q.order = append(q.order, class.Name)
+		q.classes[class.Name] = &classQueue{
+			class: class,
+			queue: UniqueQueue{
+				queue:      TimedQueue{},
+				items:      make(map[string]*TimedValue),
+				processing: util.NewStringSet(),
+				dirty:      make(map[string]TimedValue),
+			},
+		}
 	}
+	return q
 }
 
 // ActionFunc takes a timed value and returns false if the item must be retried, with an optional
 // time.Duration if some minimum wait interval should be used.
 type ActionFunc func(TimedValue) (bool, time.Duration)
 
-// Try processes the queue. Ends prematurely if RateLimiter forbids an action and leak is true.
-// Otherwise, requeues the item to be processed. Each value is processed once if fn returns true,
-// otherwise it is added back to the queue. The returned remaining is used to identify the minimum
-// time to execute the next item in the queue.
+// Try processes the queue. Items are dequeued using weighted round-robin across the configured
+// priority classes: each class is given a turn, in order, while its deficit counter is positive
+// and it has an item whose Next has passed; taking a turn decrements that class's deficit by the
+// item's Cost. Once no class can make progress, every class's deficit is refilled by its weight
+// and the scan starts over. Each item's Cost tokens are reserved on its class's RateLimiter: in
+// leak mode a reservation that isn't immediately ready is cancelled and the item is requeued to
+// be tried again after the reservation's delay, moving on to other classes in the meantime; in
+// non-leak mode Try blocks for the delay instead. If fn returns true the item is forgotten;
+// otherwise it is requeued with an exponentially increasing backoff (see AddRateLimited), or with
+// fn's requested wait, whichever is longer. Try returns once no class has an item whose Next has
+// passed.
 func (q *RateLimitedTimedQueue) Try(fn ActionFunc) {
-	val, ok := q.queue.Get()
-	for ok {
-		// rate limit the queue checking
-		if q.leak {
-			if !q.limiter.CanAccept() {
-				break
+	q.TryContext(context.Background(), fn)
+}
+
+// TryContext is Try, but ctx can be cancelled to return early, including while blocked waiting out
+// a reservation's delay in non-leak mode. Useful so controller shutdown doesn't have to wait for
+// Try's current wait to elapse.
+func (q *RateLimitedTimedQueue) TryContext(ctx context.Context, fn ActionFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		name, val, ok := q.next()
+		if !ok {
+			return
+		}
+		cq := q.classes[name]
+
+		reservation := cq.class.Limiter.ReserveN(val.cost())
+		if !reservation.OK() {
+			// val's cost exceeds the class's configured burst, so it can never be reserved; waiting
+			// on Delay() here would block forever (or requeue with an effectively infinite Next).
+			// Process it unthrottled rather than wedge the class.
+			reservation.Cancel()
+			glog.Warningf("priority class %q: cost %d for %q exceeds the configured burst; processing without rate limiting", name, val.cost(), val.Value)
+		} else if delay := reservation.Delay(); delay > 0 {
+			if q.leak {
+				reservation.Cancel()
+				q.requeueAfter(cq, val, delay)
+				q.drainDeficit(name)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				reservation.Cancel()
+				q.requeue(cq, val)
+				return
+			case <-time.After(delay):
 			}
-		} else {
-			q.limiter.Accept()
 		}
 
-		now := now()
-		if now.Before(val.Next) {
-			q.queue.Add(val)
-			val, ok = q.queue.Get()
-			// we do not sleep here because other values may be added at the front of the queue
+		n := now()
+		if n.Before(val.Next) {
+			q.requeue(cq, val)
 			continue
 		}
 
-		if ok, wait := fn(val); !ok {
-			val.Next = now.Add(wait + 1)
-			q.queue.Add(val)
+		done, wait := fn(val)
+		cq.queue.Done(val.Value)
+		if done {
+			q.Forget(val.Value)
+			q.forgetOwnerIfUnused(val.Value, cq)
+			continue
 		}
-		val, ok = q.queue.Get()
+
+		backoff := q.failureBackoff(val.Value)
+		if wait > backoff {
+			backoff = wait
+		}
+		val.Next = n.Add(backoff)
+		cq.queue.Add(val)
 	}
 }
 
-// Adds value to the queue to be processed. Won't add the same value a second time if it was already
-// added and not removed.
+// next selects the head item of the next class whose deficit is positive and whose head item's
+// Next has passed, in round-robin order, decrementing that class's deficit by the item's cost. If
+// every class with a due head item has exhausted its deficit, deficits are refilled by weight and
+// the scan is retried. Returns ok=false once no class has an item whose Next has passed.
+func (q *RateLimitedTimedQueue) next() (string, TimedValue, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		anyDue := false
+		for _, name := range q.order {
+			cq := q.classes[name]
+			cq.queue.lock.Lock()
+			due := len(cq.queue.queue) > 0 && !now().Before(cq.queue.queue[0].Next)
+			cq.queue.lock.Unlock()
+			if !due {
+				continue
+			}
+			anyDue = true
+			if cq.deficit <= 0 {
+				continue
+			}
+			val, ok := cq.queue.Get()
+			if !ok {
+				continue
+			}
+			cq.deficit -= val.cost()
+			return name, val, true
+		}
+		if !anyDue {
+			return "", TimedValue{}, false
+		}
+		for _, name := range q.order {
+			q.classes[name].deficit += q.classes[name].class.Weight
+		}
+	}
+}
+
+// drainDeficit zeroes a class's deficit so Try's round-robin moves on to the next class instead
+// of retrying one whose Limiter just refused an item.
+func (q *RateLimitedTimedQueue) drainDeficit(name string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.classes[name].deficit = 0
+}
+
+// requeue releases val from processing and puts it straight back onto cq's heap, unchanged, for a
+// future next() call to return. Used when an item is pulled off the heap but turns out not to be
+// actionable yet (not due, or rate limited), as opposed to a failed fn call, which uses
+// failureBackoff to push Next out.
+func (q *RateLimitedTimedQueue) requeue(cq *classQueue, val TimedValue) {
+	cq.queue.Done(val.Value)
+	cq.queue.Add(val)
+}
+
+// requeueAfter is requeue, but also pushes val.Next out by delay, for an item whose reservation
+// wasn't immediately ready.
+func (q *RateLimitedTimedQueue) requeueAfter(cq *classQueue, val TimedValue, delay time.Duration) {
+	val.Next = now().Add(delay)
+	q.requeue(cq, val)
+}
+
+// Adds value to the default priority class, to be processed. Won't add the same value a second
+// time if it was already added and not removed. Kept for callers that predate priority classes;
+// see AddToClass to add to a specific class.
 func (q *RateLimitedTimedQueue) Add(value string) bool {
-	now := now()
-	return q.queue.Add(TimedValue{
+	return q.AddToClass(value, defaultPriorityClass)
+}
+
+// AddToClass adds value to the named priority class, to be processed. Won't add the same value a
+// second time if it was already added and not removed, even under a different class: if value is
+// currently owned by another class, AddToClass refuses and returns false rather than double-queue
+// it. Returns false if class does not name a configured PriorityClass.
+func (q *RateLimitedTimedQueue) AddToClass(value string, class string) bool {
+	cq, ok := q.claimOwner(value, class)
+	if !ok {
+		return false
+	}
+
+	n := now()
+	return cq.queue.Add(TimedValue{
 		Value: value,
-		Added: now,
-		Next:  now,
+		Added: n,
+		Next:  n,
 	})
 }
 
-// Removes Node from the Evictor. The Node won't be processed until added again.
+// claimOwner looks up class and, if value isn't already owned by a different class, records class
+// as its owner. Returns the classQueue and true if the caller may proceed to add value to it.
+func (q *RateLimitedTimedQueue) claimOwner(value string, class string) (*classQueue, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	cq, ok := q.classes[class]
+	if !ok {
+		return nil, false
+	}
+	if owner, exists := q.owners[value]; exists && owner != class {
+		return nil, false
+	}
+	q.owners[value] = class
+	return cq, true
+}
+
+// AddRateLimited re-adds value to the default priority class after an exponentially increasing
+// backoff computed from how many times it has failed since the last Forget. Kept for callers
+// that predate priority classes; see AddRateLimitedToClass to target a specific class.
+func (q *RateLimitedTimedQueue) AddRateLimited(value string) bool {
+	return q.AddRateLimitedToClass(value, defaultPriorityClass)
+}
+
+// AddRateLimitedToClass is like AddToClass, but sets Next to now plus an exponentially increasing
+// backoff (backoffBase * 2^failures, capped at backoffMax) based on how many times value has
+// failed since the last Forget, mirroring client-go workqueue's rate-limiting semantics. Returns
+// false if class does not name a configured PriorityClass.
+func (q *RateLimitedTimedQueue) AddRateLimitedToClass(value string, class string) bool {
+	cq, ok := q.claimOwner(value, class)
+	if !ok {
+		return false
+	}
+
+	n := now()
+	return cq.queue.Add(TimedValue{
+		Value: value,
+		Added: n,
+		Next:  n.Add(q.failureBackoff(value)),
+	})
+}
+
+// failureBackoff records another failure for value and returns the exponential backoff to apply
+// before it is retried: backoffBase * 2^failures, capped at backoffMax.
+func (q *RateLimitedTimedQueue) failureBackoff(value string) time.Duration {
+	q.lock.Lock()
+	failures := q.failures[value]
+	q.failures[value] = failures + 1
+	q.lock.Unlock()
+
+	if failures > 20 {
+		failures = 20
+	}
+	backoff := backoffBase * time.Duration(1<<uint(failures))
+	if backoff <= 0 || backoff > backoffMax {
+		backoff = backoffMax
+	}
+	return backoff
+}
+
+// Forget clears the failure count recorded for value, so a future AddRateLimited call starts
+// backing off from zero again. Callers should call this once a value has been processed
+// successfully.
+func (q *RateLimitedTimedQueue) Forget(value string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.failures, value)
+}
+
+// Get returns the queued value with the earliest Next from the default priority class, whether or
+// not that Next has passed, and marks it as processing,
+// mirroring client-go's workqueue.Interface.Get; pair it with Done once the value has been
+// handled. Kept for callers that predate priority classes; see GetFromClass to target a specific
+// class. Most callers should prefer Try/TryContext, which additionally handle rate limiting and
+// weighted class selection across all classes.
+func (q *RateLimitedTimedQueue) Get() (TimedValue, bool) {
+	return q.GetFromClass(defaultPriorityClass)
+}
+
+// GetFromClass is Get, but returns the value with the earliest Next from the named class
+// specifically. Returns false if class does not name a configured PriorityClass, or it has no
+// queued value.
+func (q *RateLimitedTimedQueue) GetFromClass(class string) (TimedValue, bool) {
+	q.lock.Lock()
+	cq, ok := q.classes[class]
+	q.lock.Unlock()
+	if !ok {
+		return TimedValue{}, false
+	}
+	return cq.queue.Get()
+}
+
+// Done marks value, in whichever priority class owns it, as no longer processing. If it was
+// re-added while processing, it is moved back onto that class's queue so a future Try returns it
+// again. Does nothing if value has no owning class.
+func (q *RateLimitedTimedQueue) Done(value string) {
+	q.lock.Lock()
+	class, ok := q.owners[value]
+	q.lock.Unlock()
+	if !ok {
+		return
+	}
+	q.classes[class].queue.Done(value)
+}
+
+// forgetOwnerIfUnused drops value's owning-class record once cq no longer tracks it in any form
+// (ready, dirty, or processing), so a future Add may freely pick a new class for it. It only
+// deletes the record if cq's class is still the recorded owner: if value was concurrently
+// Remove()d and re-added under a different class in the meantime, that class's ownership claim
+// must not be clobbered by this now-stale caller.
+func (q *RateLimitedTimedQueue) forgetOwnerIfUnused(value string, cq *classQueue) {
+	if cq.queue.Has(value) {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.owners[value] == cq.class.Name {
+		delete(q.owners, value)
+	}
+}
+
+// SetLimitForClass changes the qps and burst of the named priority class's RateLimiter at
+// runtime, without recreating the queue or losing items already queued. Does nothing if class
+// does not name a configured PriorityClass.
+func (q *RateLimitedTimedQueue) SetLimitForClass(class string, qps float32, burst int) {
+	q.lock.Lock()
+	cq, ok := q.classes[class]
+	q.lock.Unlock()
+	if !ok {
+		return
+	}
+	cq.class.Limiter.SetLimit(qps, burst)
+}
+
+// SetLimit changes the qps and burst of the default priority class's RateLimiter at runtime.
+// Kept for callers that predate priority classes; see SetLimitForClass to update a specific
+// class.
+func (q *RateLimitedTimedQueue) SetLimit(qps float32, burst int) {
+	q.SetLimitForClass(defaultPriorityClass, qps, burst)
+}
+
+// Removes Node from the Evictor, regardless of which priority class it was added under. The Node
+// won't be processed until added again, and may then be added under any class. If value is
+// currently processing (mid-Try), its ownership record is kept until that Try turn finishes,
+// rather than released immediately: releasing it early would let a concurrent AddToClass under a
+// different class race ahead of the in-flight turn and end up double-queued once that turn
+// completes.
 func (q *RateLimitedTimedQueue) Remove(value string) bool {
-	return q.queue.Remove(value)
+	q.lock.Lock()
+	class, ok := q.owners[value]
+	q.lock.Unlock()
+	if !ok {
+		return false
+	}
+	cq := q.classes[class]
+	removed := cq.queue.Remove(value)
+	q.forgetOwnerIfUnused(value, cq)
+	return removed
 }
@@ -0,0 +1,446 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodecontroller
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// fakeReservation is a Reservation with a caller-controlled OK/Delay, for deterministic tests.
+type fakeReservation struct {
+	ok    bool
+	delay time.Duration
+}
+
+func (r *fakeReservation) OK() bool             { return r.ok }
+func (r *fakeReservation) Delay() time.Duration { return r.delay }
+func (r *fakeReservation) Cancel()              {}
+
+// fakeRateLimiter is a RateLimiter that never actually delays: ReserveN succeeds with zero delay
+// as long as n doesn't exceed the configured burst, and fails (OK()==false) otherwise. This lets
+// tests exercise Try/TryContext's scheduling logic without depending on wall-clock rate limiting.
+type fakeRateLimiter struct {
+	lock  sync.Mutex
+	burst int
+}
+
+func newFakeRateLimiter(burst int) *fakeRateLimiter {
+	return &fakeRateLimiter{burst: burst}
+}
+
+func (r *fakeRateLimiter) ReserveN(n int) Reservation {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return &fakeReservation{ok: n <= r.burst}
+}
+
+func (r *fakeRateLimiter) SetLimit(qps float32, burst int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.burst = burst
+}
+
+func newBenchmarkQueue(n int) (*UniqueQueue, []string) {
+	q := &UniqueQueue{
+		queue:      TimedQueue{},
+		items:      make(map[string]*TimedValue),
+		processing: util.NewStringSet(),
+		dirty:      make(map[string]TimedValue),
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = fmt.Sprintf("node-%d", i)
+	}
+	added := time.Now()
+	for _, value := range values {
+		q.Add(TimedValue{Value: value, Added: added, Next: added})
+	}
+	return q, values
+}
+
+// withFakeNow overrides the package-level now() var for the duration of a test and restores it on
+// cleanup, so tests can control Next/Added timestamps without depending on wall-clock time.
+func withFakeNow(t *testing.T, start time.Time) func() time.Time {
+	t.Helper()
+	current := start
+	orig := now
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = orig })
+	return func() time.Time { return current }
+}
+
+// TestTryOrdering verifies that Try processes ready items in Next order (oldest first), not
+// insertion or arbitrary map order.
+func TestTryOrdering(t *testing.T) {
+	withFakeNow(t, time.Unix(1000, 0))
+
+	q := NewRateLimitedTimedQueue(newFakeRateLimiter(1000), false)
+	for i, value := range []string{"c", "a", "b"} {
+		added := time.Unix(1000+int64(i), 0)
+		now = func() time.Time { return added }
+		if !q.Add(value) {
+			t.Fatalf("Add(%q) = false, want true", value)
+		}
+	}
+	now = func() time.Time { return time.Unix(2000, 0) }
+
+	var processed []string
+	q.Try(func(v TimedValue) (bool, time.Duration) {
+		processed = append(processed, v.Value)
+		return true, 0
+	})
+
+	want := []string{"c", "a", "b"}
+	if !reflect.DeepEqual(processed, want) {
+		t.Errorf("Try processed %v, want %v (oldest Next first)", processed, want)
+	}
+}
+
+// TestPriorityWeightedRoundRobin verifies that next() dequeues items from multiple classes in
+// proportion to their configured Weight, rather than draining one class before touching another.
+func TestPriorityWeightedRoundRobin(t *testing.T) {
+	withFakeNow(t, time.Unix(1000, 0))
+
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 3, Limiter: newFakeRateLimiter(1000)},
+		{Name: "low", Weight: 1, Limiter: newFakeRateLimiter(1000)},
+	}, false)
+
+	for i := 0; i < 9; i++ {
+		q.AddToClass(fmt.Sprintf("high-%d", i), "high")
+	}
+	for i := 0; i < 3; i++ {
+		q.AddToClass(fmt.Sprintf("low-%d", i), "low")
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 12; i++ {
+		name, _, ok := q.next()
+		if !ok {
+			t.Fatalf("next() = (_, _, false) after only %d of 12 items", i)
+		}
+		counts[name]++
+	}
+	if counts["high"] != 9 || counts["low"] != 3 {
+		t.Errorf("got %v dequeues, want 9 high and 3 low to preserve the 3:1 weight ratio", counts)
+	}
+}
+
+// TestSetLimitForClassAppliesAtRuntime verifies that SetLimitForClass changes a class's RateLimiter
+// behavior immediately, in place, without recreating the queue or losing items already queued.
+func TestSetLimitForClassAppliesAtRuntime(t *testing.T) {
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 1, Limiter: NewRateLimiter(0, 1)},
+	}, false)
+
+	if !q.AddToClass("node1", "high") {
+		t.Fatalf("AddToClass(node1, high) = false, want true")
+	}
+
+	limiter := q.classes["high"].class.Limiter
+	if r := limiter.ReserveN(5); r.OK() {
+		r.Cancel()
+		t.Fatalf("ReserveN(5) with burst=1 unexpectedly succeeded before SetLimitForClass")
+	}
+
+	q.SetLimitForClass("high", 0, 10)
+
+	if r := limiter.ReserveN(5); !r.OK() {
+		t.Errorf("ReserveN(5) still fails after SetLimitForClass raised burst to 10")
+	} else {
+		r.Cancel()
+	}
+
+	name, val, ok := q.next()
+	if !ok || name != "high" || val.Value != "node1" {
+		t.Errorf(`next() = (%q, %+v, %v), want ("high", node1, true); SetLimitForClass must not drop queued items`, name, val, ok)
+	}
+}
+
+// TestUniqueQueueDirtyReAdd verifies that re-Add()ing a value that Get() already returned defers
+// the new value as dirty instead of queuing it a second time, and that Done() moves the dirty
+// value onto the queue so a later Get() returns it.
+func TestUniqueQueueDirtyReAdd(t *testing.T) {
+	q, _ := newBenchmarkQueue(0)
+	added := time.Unix(1000, 0)
+	if !q.Add(TimedValue{Value: "node1", Added: added, Next: added}) {
+		t.Fatalf("Add(node1) = false, want true")
+	}
+
+	got, ok := q.Get()
+	if !ok || got.Value != "node1" {
+		t.Fatalf("Get() = (%+v, %v), want (node1, true)", got, ok)
+	}
+
+	// node1 is now processing; re-adding it should be deferred as dirty, not queued.
+	redone := time.Unix(2000, 0)
+	if !q.Add(TimedValue{Value: "node1", Added: redone, Next: redone}) {
+		t.Errorf("Add(node1) while processing = false, want true (first re-add while dirty)")
+	}
+	if _, ok := q.Get(); ok {
+		t.Errorf("Get() returned a value while node1 was still processing and only dirty, want false")
+	}
+	if q.Add(TimedValue{Value: "node1", Added: redone, Next: redone}) {
+		t.Errorf("second Add(node1) while already dirty = true, want false")
+	}
+
+	q.Done("node1")
+
+	got, ok = q.Get()
+	if !ok || got.Value != "node1" || !got.Next.Equal(redone) {
+		t.Errorf("Get() after Done() = (%+v, %v), want the re-added value (Next=%v, true)", got, ok, redone)
+	}
+}
+
+// TestRemoveDuringProcessingRetainsOwnership verifies that Remove doesn't release a value's
+// ownership record while it's still mid-flight (returned by Get but not yet Done), so a
+// concurrent AddToClass under a different class can't race ahead and end up double-queued once
+// the in-flight turn completes.
+func TestRemoveDuringProcessingRetainsOwnership(t *testing.T) {
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 1, Limiter: newFakeRateLimiter(1000)},
+		{Name: "low", Weight: 1, Limiter: newFakeRateLimiter(1000)},
+	}, false)
+
+	if !q.AddToClass("node1", "high") {
+		t.Fatalf("AddToClass(node1, high) = false, want true")
+	}
+	val, ok := q.GetFromClass("high")
+	if !ok || val.Value != "node1" {
+		t.Fatalf("GetFromClass(high) = (%+v, %v), want (node1, true)", val, ok)
+	}
+
+	// node1 is now mid-flight (processing) under "high". Remove must not release ownership yet.
+	q.Remove("node1")
+	if q.AddToClass("node1", "low") {
+		t.Errorf(`AddToClass(node1, low) succeeded while node1 was still processing under "high"; ownership was released too early`)
+	}
+
+	// Once the in-flight turn finishes and calls Done, ownership is released and node1 may move.
+	q.Done("node1")
+	q.forgetOwnerIfUnused("node1", q.classes["high"])
+	if !q.AddToClass("node1", "low") {
+		t.Errorf(`AddToClass(node1, low) = false after node1 finished processing under "high", want true`)
+	}
+}
+
+// TestForgetOwnerIfUnusedDoesNotClobberNewOwner verifies that forgetOwnerIfUnused only deletes an
+// ownership record if its caller's class is still the recorded owner, so a stale caller (racing
+// behind a legitimate Remove-then-AddToClass-elsewhere) can't clobber a different class's claim.
+func TestForgetOwnerIfUnusedDoesNotClobberNewOwner(t *testing.T) {
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 1, Limiter: newFakeRateLimiter(1000)},
+		{Name: "low", Weight: 1, Limiter: newFakeRateLimiter(1000)},
+	}, false)
+
+	// Simulate node1 having already been claimed by "low" by the time a stale caller from "high"
+	// tries to release ownership.
+	q.owners["node1"] = "low"
+
+	q.forgetOwnerIfUnused("node1", q.classes["high"])
+
+	if owner := q.owners["node1"]; owner != "low" {
+		t.Errorf(`forgetOwnerIfUnused from a non-owning class changed owners["node1"] to %q, want "low" left untouched`, owner)
+	}
+}
+
+// TestAddRateLimitedBackoff verifies that AddRateLimited's backoff grows exponentially with
+// consecutive failures, caps at backoffMax, and resets once Forget is called.
+func TestAddRateLimitedBackoff(t *testing.T) {
+	currentNow := withFakeNow(t, time.Unix(1000, 0))
+
+	q := NewRateLimitedTimedQueue(newFakeRateLimiter(1000), false)
+
+	wantBackoff := backoffBase
+	for i := 0; i < 3; i++ {
+		if !q.AddRateLimited("node1") {
+			t.Fatalf("AddRateLimited(node1) = false, want true on attempt %d", i)
+		}
+		val, ok := q.GetFromClass(defaultPriorityClass)
+		if !ok {
+			t.Fatalf("GetFromClass returned nothing after AddRateLimited on attempt %d", i)
+		}
+		if got := val.Next.Sub(currentNow()); got != wantBackoff {
+			t.Errorf("attempt %d: backoff = %v, want %v", i, got, wantBackoff)
+		}
+		q.Done("node1")
+		wantBackoff *= 2
+	}
+
+	// After many failures, backoff should be capped at backoffMax rather than keep growing.
+	for i := 0; i < 20; i++ {
+		q.AddRateLimited("node1")
+		val, _ := q.GetFromClass(defaultPriorityClass)
+		q.Done("node1")
+		if i == 19 {
+			if got := val.Next.Sub(currentNow()); got != backoffMax {
+				t.Errorf("backoff after many failures = %v, want capped backoffMax %v", got, backoffMax)
+			}
+		}
+	}
+
+	// Forget should reset the failure count, so the next AddRateLimited backs off from the base
+	// again instead of continuing from the capped value.
+	q.Forget("node1")
+	q.AddRateLimited("node1")
+	val, ok := q.GetFromClass(defaultPriorityClass)
+	if !ok {
+		t.Fatalf("GetFromClass returned nothing after AddRateLimited following Forget")
+	}
+	if got := val.Next.Sub(currentNow()); got != backoffBase {
+		t.Errorf("backoff right after Forget = %v, want base backoff %v", got, backoffBase)
+	}
+	q.Done("node1")
+}
+
+// TestNextConsumesCost verifies that next() decrements a class's deficit by an item's Cost rather
+// than a flat 1. With a single class, a spent deficit is refilled again immediately (there's no
+// other class for it to wait its turn behind), so this checks the deficit accounting directly
+// rather than asserting that a cost-5 item starves a later cost-1 item in the same class.
+func TestNextConsumesCost(t *testing.T) {
+	withFakeNow(t, time.Unix(1000, 0))
+
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 5, Limiter: newFakeRateLimiter(1000)},
+	}, false)
+
+	cq := q.classes["high"]
+	cq.queue.Add(TimedValue{Value: "expensive", Next: now(), Cost: 5})
+	cq.queue.Add(TimedValue{Value: "cheap", Next: now(), Cost: 1})
+
+	name, val, ok := q.next()
+	if !ok || name != "high" || val.Value != "expensive" {
+		t.Fatalf("first next() = (%q, %+v, %v), want (\"high\", expensive, true)", name, val, ok)
+	}
+	// A weight-5 class refilled by 5 and immediately spent by a cost-5 item should land back at a
+	// zero deficit, not the flat "-1 per item" a cost-blind round robin would produce.
+	if cq.deficit != 0 {
+		t.Errorf("deficit after a cost-5 item in a weight-5 class = %d, want 0", cq.deficit)
+	}
+
+	// With only one class, next() self-refills rather than starving, so the cost-1 item is
+	// returned right away too.
+	name, val, ok = q.next()
+	if !ok || name != "high" || val.Value != "cheap" {
+		t.Fatalf("second next() = (%q, %+v, %v), want (\"high\", cheap, true)", name, val, ok)
+	}
+	if cq.deficit != 4 {
+		t.Errorf("deficit after the cost-1 item = %d, want 4 (refilled by 5, spent 1)", cq.deficit)
+	}
+}
+
+// TestTryOKFalseProcessesWithoutBlocking verifies that when a Reservation reports !OK() (cost
+// exceeds the class's burst), Try processes the item immediately instead of blocking forever on
+// Delay(), which would be rate.InfDuration in that situation.
+func TestTryOKFalseProcessesWithoutBlocking(t *testing.T) {
+	withFakeNow(t, time.Unix(1000, 0))
+
+	q := NewPriorityRateLimitedTimedQueue([]PriorityClass{
+		{Name: "high", Weight: 1, Limiter: newFakeRateLimiter(5)},
+	}, false)
+	q.AddToClass("node1", "high")
+	q.classes["high"].queue.items["node1"].Cost = 1000
+
+	done := make(chan struct{})
+	go func() {
+		q.Try(func(v TimedValue) (bool, time.Duration) {
+			return true, 0
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Try blocked instead of processing an item whose cost exceeds the class's burst")
+	}
+}
+
+// TestTryContextCancellation verifies that cancelling ctx interrupts TryContext while it's blocked
+// waiting out a reservation's delay, instead of waiting for the delay to elapse.
+func TestTryContextCancellation(t *testing.T) {
+	withFakeNow(t, time.Unix(1000, 0))
+
+	limiter := newFakeRateLimiter(1000)
+	q := NewRateLimitedTimedQueue(limiter, false)
+	q.Add("node1")
+
+	// Swap in a limiter that reports a long, never-arriving delay, so the only way out of
+	// TryContext's wait is ctx cancellation.
+	q.classes[defaultPriorityClass].class.Limiter = delayingRateLimiter{delay: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	called := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.TryContext(ctx, func(v TimedValue) (bool, time.Duration) {
+			close(called)
+			return true, 0
+		})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TryContext did not return promptly after ctx was cancelled while waiting out a reservation delay")
+	}
+	select {
+	case <-called:
+		t.Error("fn was called despite ctx being cancelled before the reservation's delay elapsed")
+	default:
+	}
+}
+
+// delayingRateLimiter always reserves successfully but with a caller-specified delay, used to
+// exercise TryContext's blocking-wait/cancellation path deterministically.
+type delayingRateLimiter struct {
+	delay time.Duration
+}
+
+func (r delayingRateLimiter) ReserveN(n int) Reservation {
+	return &fakeReservation{ok: true, delay: r.delay}
+}
+
+func (r delayingRateLimiter) SetLimit(qps float32, burst int) {}
+
+// BenchmarkUniqueQueueRemove demonstrates that Remove no longer scans the whole heap: wall time
+// should grow roughly with n*log(n), not n^2, as n grows past 10k.
+func BenchmarkUniqueQueueRemove(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				q, values := newBenchmarkQueue(n)
+				b.StartTimer()
+
+				for _, value := range values {
+					q.Remove(value)
+				}
+			}
+		})
+	}
+}